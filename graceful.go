@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// listenFDsStart is the first inherited file descriptor used for
+// socket-activated listeners, matching the systemd convention (fd 0-2 are
+// stdin/stdout/stderr).
+const listenFDsStart = 3
+
+// defaultHammerTime is how long gracefulServer waits for clients to drain
+// on their own before forcibly closing their connections.
+const defaultHammerTime = 10 * time.Second
+
+// statePath is where the firefly grid is persisted across restarts.
+const statePath = "firefly_state.json"
+
+// roomSnapshot is one room's persisted config plus its active-cell layout.
+type roomSnapshot struct {
+	RoomConfig
+	Active []bool `json:"active"`
+}
+
+// persistedState is the on-disk snapshot of every room, enough to restore
+// each room's active/inactive cell layout and sync model after a restart.
+//
+// Known limitation: it does NOT capture each firefly's in-cycle phase —
+// newRoomFromConfig re-seeds every restored firefly's state blob from a
+// freshly-seeded RNG (see initializeState), so a SIGHUP or SIGTERM restart
+// resumes which cells were on/off but re-randomizes their flash timing.
+// "Simulation continuity across restarts" is cell-layout continuity, not
+// full timing continuity; doing better would mean teaching SyncModel to
+// (de)serialize its opaque per-firefly state blob.
+type persistedState struct {
+	Rooms []roomSnapshot `json:"rooms"`
+}
+
+// saveState snapshots every room's active-cell layout and sync model, for
+// reload on the next start. It does not capture in-cycle phase — see
+// persistedState.
+func (s *Server) saveState(path string) error {
+	s.mutex.RLock()
+	ps := persistedState{Rooms: make([]roomSnapshot, 0, len(s.rooms))}
+	for _, room := range s.rooms {
+		ps.Rooms = append(ps.Rooms, room.snapshot())
+	}
+	s.mutex.RUnlock()
+
+	data, err := json.Marshal(ps)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadPersistedState reads a snapshot written by saveState, if present.
+func loadPersistedState(path string) *persistedState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var ps persistedState
+	if err := json.Unmarshal(data, &ps); err != nil {
+		log.Printf("Ignoring unreadable state file %s: %v", path, err)
+		return nil
+	}
+	return &ps
+}
+
+// gracefulServer wraps an http.Server with signal handling, systemd-style
+// socket activation, and SIGHUP-triggered hot restart, draining connected
+// WebSocket clients before any listener is torn down.
+type gracefulServer struct {
+	httpServer *http.Server
+	listener   net.Listener
+	sim        *Server
+	hammerTime time.Duration
+}
+
+// newGracefulServer wraps httpServer/listener/sim so Serve can coordinate
+// shutdown and restart across all three.
+func newGracefulServer(httpServer *http.Server, listener net.Listener, sim *Server) *gracefulServer {
+	return &gracefulServer{
+		httpServer: httpServer,
+		listener:   listener,
+		sim:        sim,
+		hammerTime: defaultHammerTime,
+	}
+}
+
+// Serve runs the HTTP server until a termination signal is received, then
+// drains clients and persists state (SIGTERM/SIGINT) or hands the listening
+// socket to a freshly exec'd copy of the binary before draining and exiting
+// (SIGHUP).
+func (g *gracefulServer) Serve() error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- g.httpServer.Serve(g.listener)
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				log.Println("Received SIGHUP, starting hot restart")
+				// Persist the live grid before spawning the child: it calls
+				// loadPersistedState(statePath) almost immediately on start,
+				// well before this process finishes draining.
+				if err := g.sim.saveState(statePath); err != nil {
+					log.Printf("Failed to persist simulation state before hot restart: %v", err)
+				}
+				if err := g.reexec(); err != nil {
+					log.Printf("Hot restart failed, continuing to serve: %v", err)
+					continue
+				}
+			} else {
+				log.Printf("Received %s, shutting down gracefully", sig)
+			}
+			return g.shutdown()
+		}
+	}
+}
+
+// shutdown stops accepting new connections, drains existing clients with a
+// close frame (hammering them closed after hammerTime), and persists the
+// simulation state to disk.
+func (g *gracefulServer) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.hammerTime)
+	defer cancel()
+	if err := g.httpServer.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown error: %v", err)
+	}
+
+	g.drainClients()
+
+	if err := g.sim.saveState(statePath); err != nil {
+		log.Printf("Failed to persist simulation state: %v", err)
+	}
+	return nil
+}
+
+// drainClients sends every connected client, across every room, a close
+// frame and waits up to hammerTime for them to disconnect on their own,
+// then force-closes whatever is left.
+func (g *gracefulServer) drainClients() {
+	g.sim.mutex.RLock()
+	rooms := make([]*Room, 0, len(g.sim.rooms))
+	for _, room := range g.sim.rooms {
+		rooms = append(rooms, room)
+	}
+	g.sim.mutex.RUnlock()
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, room := range rooms {
+		room.mutex.RLock()
+		for c := range room.clients {
+			_ = c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		}
+		room.mutex.RUnlock()
+	}
+
+	deadline := time.Now().Add(g.hammerTime)
+	for time.Now().Before(deadline) {
+		if totalClients(rooms) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Println("Hammer time reached, forcibly closing remaining clients")
+	for _, room := range rooms {
+		room.mutex.Lock()
+		for c := range room.clients {
+			_ = c.conn.Close()
+			delete(room.clients, c)
+		}
+		room.mutex.Unlock()
+	}
+}
+
+// totalClients sums the number of connected clients across rooms.
+func totalClients(rooms []*Room) int {
+	total := 0
+	for _, room := range rooms {
+		room.mutex.RLock()
+		total += len(room.clients)
+		room.mutex.RUnlock()
+	}
+	return total
+}
+
+// reexec forks and execs a fresh copy of the running binary, passing the
+// listening socket as an inherited file descriptor so the new process can
+// pick up accepting connections without dropping the port. The old process
+// is expected to drain and exit after this returns successfully.
+func (g *gracefulServer) reexec() error {
+	listenerFile, err := listenerFile(g.listener)
+	if err != nil {
+		return fmt.Errorf("getting listener file: %w", err)
+	}
+	defer listenerFile.Close()
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("resolving executable path: %w", err)
+	}
+
+	cmd := exec.Command(execPath, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{listenerFile}
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS=1",
+		// The child's real pid isn't known until after Start, so unlike
+		// strict systemd socket activation this is checked leniently: any
+		// process inheriting FIREFLY_SOCKET_ACTIVATED treats fd 3 as its
+		// listener regardless of the recorded pid.
+		"LISTEN_PID=0",
+		"FIREFLY_SOCKET_ACTIVATED=1",
+	)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting new process: %w", err)
+	}
+	log.Printf("Started replacement process pid=%d, draining this one", cmd.Process.Pid)
+	return nil
+}
+
+// listenerFile extracts the underlying *os.File from a listener so it can
+// be passed to a child process, unwrapping the TLS listener this server
+// always runs behind.
+func listenerFile(l net.Listener) (*os.File, error) {
+	tl, ok := l.(*tlsListenerWithFiler)
+	if !ok {
+		return nil, fmt.Errorf("listener of type %T does not support extracting a file descriptor", l)
+	}
+	return tl.inner.File()
+}
+
+// tlsListenerWithFiler wraps a tls.Listener alongside the underlying TCP
+// listener it was built from, since tls.Listener itself doesn't expose a
+// way back to the raw socket needed for fd-passing.
+type tlsListenerWithFiler struct {
+	net.Listener
+	inner *net.TCPListener
+}
+
+// newTLSListener wraps a plain TCP listener (either freshly opened or
+// inherited via socket activation) with TLS, while keeping a handle on the
+// original listener for hot-restart fd-passing.
+func newTLSListener(inner *net.TCPListener, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return &tlsListenerWithFiler{
+		Listener: tls.NewListener(inner, config),
+		inner:    inner,
+	}, nil
+}
+
+// listen returns a TCP listener for addr, reusing a systemd-style
+// socket-activated file descriptor (LISTEN_FDS / fd 3 onward) when present
+// so a hot-restarted or socket-activated process never drops the port.
+func listen(addr string) (*net.TCPListener, error) {
+	if l := activatedListener(); l != nil {
+		return l, nil
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// activatedListener builds a *net.TCPListener from an inherited file
+// descriptor if LISTEN_FDS indicates one was passed down, per the
+// systemd socket-activation protocol (leniently: see reexec's LISTEN_PID
+// comment).
+func activatedListener() *net.TCPListener {
+	numFDs, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFDs < 1 {
+		return nil
+	}
+	file := os.NewFile(uintptr(listenFDsStart), "listen-socket")
+	if file == nil {
+		return nil
+	}
+	l, err := net.FileListener(file)
+	if err != nil {
+		log.Printf("Failed to use activated socket, falling back to a fresh listener: %v", err)
+		return nil
+	}
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		log.Println("Activated socket is not a TCP listener, falling back to a fresh listener")
+		return nil
+	}
+	return tcpListener
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds every Prometheus collector this server exposes, labeled by
+// room ID so operators can see which simulation is responsible for load.
+// All fields are safe for concurrent use (prometheus collectors are).
+var metrics = struct {
+	connectedClients    *prometheus.GaugeVec
+	ticksTotal          *prometheus.CounterVec
+	tickDuration        *prometheus.HistogramVec
+	neighborScanSeconds *prometheus.HistogramVec
+	flashingFireflies   *prometheus.GaugeVec
+	broadcastInFlight   *prometheus.GaugeVec
+	droppedClients      *prometheus.CounterVec
+	writeLatency        *prometheus.HistogramVec
+}{
+	connectedClients: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "firefly_connected_clients",
+		Help: "Number of WebSocket clients currently subscribed to a room.",
+	}, []string{"room"}),
+	ticksTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "firefly_ticks_total",
+		Help: "Number of simulation ticks processed by a room.",
+	}, []string{"room"}),
+	tickDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "firefly_update_duration_seconds",
+		Help:    "Time spent walking the grid in updateFireflies per tick.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"room"}),
+	neighborScanSeconds: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "firefly_neighbor_scan_seconds",
+		Help:    "Total time per tick spent in neighborStates (the O(radius^2) per-cell scan), across all active fireflies.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"room"}),
+	flashingFireflies: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "firefly_flashing_fireflies",
+		Help: "Number of fireflies whose DisplayState was flashing (1) on the most recent tick.",
+	}, []string{"room"}),
+	broadcastInFlight: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "firefly_broadcast_in_flight",
+		Help: "Number of per-client sendState goroutines currently writing to a socket.",
+	}, []string{"room"}),
+	droppedClients: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "firefly_dropped_clients_total",
+		Help: "Number of clients removed from a room because writing to their socket failed.",
+	}, []string{"room"}),
+	writeLatency: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "firefly_client_write_latency_seconds",
+		Help:    "Latency of a single client write in sendState.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"room", "protocol"}),
+}
+
+// deleteRoomMetrics drops every per-room label series for roomID. Callers
+// must call this wherever a room is torn down (currently just gcLoop's
+// idle sweep) — otherwise every created-then-reaped room leaves its label
+// series behind forever, growing cardinality without bound.
+func deleteRoomMetrics(roomID string) {
+	labels := prometheus.Labels{"room": roomID}
+	metrics.connectedClients.DeletePartialMatch(labels)
+	metrics.ticksTotal.DeletePartialMatch(labels)
+	metrics.tickDuration.DeletePartialMatch(labels)
+	metrics.neighborScanSeconds.DeletePartialMatch(labels)
+	metrics.flashingFireflies.DeletePartialMatch(labels)
+	metrics.broadcastInFlight.DeletePartialMatch(labels)
+	metrics.droppedClients.DeletePartialMatch(labels)
+	metrics.writeLatency.DeletePartialMatch(labels)
+}
+
+// adminTokenValid reports whether r carries a valid FIREFLY_ADMIN_TOKEN
+// bearer token. With no token configured, every request is refused, so
+// nothing admin-gated can be exposed by accident on a deployment that
+// never set one up. Shared by requireAdminToken (for /admin/rooms and
+// /debug/pprof/) and handleConnections, which checks it once at WebSocket
+// upgrade time since record:start/replay:load ride an already-upgraded
+// connection with no per-message request to gate.
+func adminTokenValid(r *http.Request) bool {
+	token := os.Getenv("FIREFLY_ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// requireAdminToken gates next behind adminTokenValid.
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminTokenValid(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registerMetricsAndDebug wires /metrics and the net/http/pprof endpoints
+// onto mux, gating pprof behind requireAdminToken since it can leak stack
+// traces and memory contents.
+func registerMetricsAndDebug(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+
+	pprofMux := http.NewServeMux()
+	pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+	pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/pprof/", requireAdminToken(pprofMux))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// protocolMode selects how grid state is encoded on the wire.
+type protocolMode int
+
+const (
+	// protocolJSON sends the full grid as a JSON array of ints, as this
+	// server has always done. Kept as the default so older clients that
+	// never send a handshake keep working unmodified.
+	protocolJSON protocolMode = iota
+	// protocolBinary packs each cell into 2 bits and sends either a full
+	// keyframe or a sparse delta of changed cells, framed with a small
+	// header.
+	protocolBinary
+)
+
+// binary frame header layout (all fields little-endian):
+//
+//	byte 0      frameType (frameKeyframe or frameDelta)
+//	bytes 1-4   sequence number (uint32)
+//	bytes 5-12  timestamp, unix millis (uint64)
+//	bytes 13-16 payload-specific count/length (uint32)
+//	bytes 17-.. payload
+const binaryHeaderSize = 17
+
+const (
+	frameKeyframe byte = iota
+	frameDelta
+)
+
+// keyframeInterval is the number of ticks between forced full keyframes for
+// binary-mode clients, so a client that missed a delta (or just connected)
+// never drifts from the server's state for long.
+const keyframeInterval = 50
+
+// handshakeMessage is the first message a client may send on connect to
+// negotiate the wire protocol. Clients that skip this (or send anything
+// that doesn't parse) are left on protocolJSON for backward compatibility.
+type handshakeMessage struct {
+	Protocol string `json:"protocol"` // "json" or "binary"
+}
+
+// parseHandshake attempts to interpret the first message from a client as a
+// protocol negotiation request. ok is false if the message isn't a
+// recognized handshake, in which case callers should fall back to treating
+// it as a normal control message (e.g. "restart").
+func parseHandshake(message []byte) (mode protocolMode, ok bool) {
+	var h handshakeMessage
+	if err := json.Unmarshal(message, &h); err != nil {
+		return protocolJSON, false
+	}
+	switch h.Protocol {
+	case "binary":
+		return protocolBinary, true
+	case "json":
+		return protocolJSON, true
+	default:
+		return protocolJSON, false
+	}
+}
+
+// packCells packs a slice of firefly states (each -1, 0, or 1) 2 bits per
+// cell, big enough to round-trip all three values plus a spare.
+func packCells(states []int) []byte {
+	packed := make([]byte, (len(states)+3)/4)
+	for i, state := range states {
+		packed[i/4] |= encodeCellState(state) << (uint(i%4) * 2)
+	}
+	return packed
+}
+
+// unpackCells is the inverse of packCells, given the expected cell count.
+func unpackCells(packed []byte, count int) []int {
+	states := make([]int, count)
+	for i := range states {
+		bits := (packed[i/4] >> (uint(i%4) * 2)) & 0x3
+		states[i] = decodeCellState(bits)
+	}
+	return states
+}
+
+// encodeCellState maps a firefly state to its 2-bit wire value: 0 => 0b00,
+// 1 (flashing) => 0b01, -1 (inactive) => 0b10.
+func encodeCellState(state int) byte {
+	switch state {
+	case 1:
+		return 1
+	case -1:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func decodeCellState(bits byte) int {
+	switch bits {
+	case 1:
+		return 1
+	case 2:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// encodeKeyframe builds a full binary keyframe frame for the given flat
+// grid state.
+func encodeKeyframe(seq uint32, state []int) []byte {
+	packed := packCells(state)
+	return buildFrame(frameKeyframe, seq, uint32(len(state)), packed)
+}
+
+// cellDelta is a single (index, newState) change, as produced by diffing
+// two flattened grid snapshots.
+type cellDelta struct {
+	index int
+	state int
+}
+
+// diffState returns the cells that changed between prev and next. prev may
+// be nil, in which case every non-dim cell is reported.
+func diffState(prev, next []int) []cellDelta {
+	var deltas []cellDelta
+	for i, state := range next {
+		if prev == nil {
+			if state != 0 {
+				deltas = append(deltas, cellDelta{index: i, state: state})
+			}
+			continue
+		}
+		if prev[i] != state {
+			deltas = append(deltas, cellDelta{index: i, state: state})
+		}
+	}
+	return deltas
+}
+
+// encodeDelta builds a binary delta frame: a uint32 count followed by
+// (index uint32, state byte) pairs.
+func encodeDelta(seq uint32, deltas []cellDelta) []byte {
+	payload := make([]byte, 0, len(deltas)*5)
+	buf := make([]byte, 4)
+	for _, d := range deltas {
+		binary.LittleEndian.PutUint32(buf, uint32(d.index))
+		payload = append(payload, buf...)
+		payload = append(payload, encodeCellState(d.state))
+	}
+	return buildFrame(frameDelta, seq, uint32(len(deltas)), payload)
+}
+
+// buildFrame assembles the common header plus payload into a single
+// WebSocket binary message.
+func buildFrame(frameType byte, seq uint32, count uint32, payload []byte) []byte {
+	frame := make([]byte, binaryHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.LittleEndian.PutUint32(frame[1:5], seq)
+	binary.LittleEndian.PutUint64(frame[5:13], uint64(time.Now().UnixMilli()))
+	binary.LittleEndian.PutUint32(frame[13:17], count)
+	copy(frame[binaryHeaderSize:], payload)
+	return frame
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackUnpackCellsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []int
+	}{
+		{"empty", []int{}},
+		{"single dim", []int{0}},
+		{"single flashing", []int{1}},
+		{"single inactive", []int{-1}},
+		{"mixed, not a multiple of 4", []int{-1, 0, 1, -1, 0}},
+		{"all flashing", []int{1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packed := packCells(tt.states)
+			got := unpackCells(packed, len(tt.states))
+			if !reflect.DeepEqual(got, tt.states) {
+				t.Errorf("unpackCells(packCells(%v)) = %v, want %v", tt.states, got, tt.states)
+			}
+		})
+	}
+}
+
+func TestPackCellsSize(t *testing.T) {
+	tests := []struct {
+		count    int
+		wantSize int
+	}{
+		{0, 0},
+		{1, 1},
+		{4, 1},
+		{5, 2},
+		{8, 2},
+		{9, 3},
+	}
+	for _, tt := range tests {
+		got := len(packCells(make([]int, tt.count)))
+		if got != tt.wantSize {
+			t.Errorf("len(packCells(make([]int, %d))) = %d, want %d", tt.count, got, tt.wantSize)
+		}
+	}
+}
+
+func TestDiffStateNilPrevReportsNonDimCells(t *testing.T) {
+	next := []int{0, 1, -1, 0, 1}
+	deltas := diffState(nil, next)
+	want := []cellDelta{{index: 1, state: 1}, {index: 2, state: -1}, {index: 4, state: 1}}
+	if !reflect.DeepEqual(deltas, want) {
+		t.Errorf("diffState(nil, %v) = %v, want %v", next, deltas, want)
+	}
+}
+
+func TestDiffStateReportsOnlyChangedCells(t *testing.T) {
+	prev := []int{0, 1, -1, 0}
+	next := []int{0, 0, -1, 1}
+	deltas := diffState(prev, next)
+	want := []cellDelta{{index: 1, state: 0}, {index: 3, state: 1}}
+	if !reflect.DeepEqual(deltas, want) {
+		t.Errorf("diffState(%v, %v) = %v, want %v", prev, next, deltas, want)
+	}
+}
+
+func TestDiffStateNoChanges(t *testing.T) {
+	state := []int{0, 1, -1, 0}
+	if deltas := diffState(state, state); len(deltas) != 0 {
+		t.Errorf("diffState(state, state) = %v, want empty", deltas)
+	}
+}
+
+func TestEncodeDecodeCellStateRoundTrip(t *testing.T) {
+	for _, state := range []int{-1, 0, 1} {
+		if got := decodeCellState(encodeCellState(state)); got != state {
+			t.Errorf("decodeCellState(encodeCellState(%d)) = %d, want %d", state, got, state)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// recordingsDir is the only directory recordings are written to or read
+// from. record:start/replay:load take an opaque ID rather than a path, so
+// a client can never direct the server to open a file outside it.
+const recordingsDir = "recordings"
+
+// validRecordingID matches the ID record:start/replay:load are allowed to
+// carry: a bare token, never a path. This rejects "..", "/", and absolute
+// paths by construction rather than by trying to canonicalize and check
+// them.
+var validRecordingID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// recordingPath resolves a client-supplied recording ID to a path inside
+// recordingsDir, or an error if id isn't a bare alphanumeric/dash/underscore
+// token. Without this, record:start/replay:load would hand os.Create/
+// os.Open a client-controlled path, letting any /ws connection overwrite or
+// read an arbitrary file the process has access to.
+func recordingPath(id string) (string, error) {
+	if !validRecordingID.MatchString(id) {
+		return "", fmt.Errorf("invalid recording id %q", id)
+	}
+	return filepath.Join(recordingsDir, id+".jsonl"), nil
+}
+
+// recordedChange is the JSON-friendly mirror of cellDelta used on disk,
+// since cellDelta's fields are unexported.
+type recordedChange struct {
+	Index int `json:"index"`
+	State int `json:"state"`
+}
+
+// recordEvent is one line of a recording. The first event in a file is
+// always a header (Seed/GridSize/Model set, Changes nil); every event
+// after that carries the tick number and the cells that changed since the
+// previous recorded tick.
+type recordEvent struct {
+	Seed     *int64           `json:"seed,omitempty"`
+	GridSize int              `json:"gridSize,omitempty"`
+	Model    string           `json:"model,omitempty"`
+	Tick     uint32           `json:"tick"`
+	Changes  []recordedChange `json:"changes,omitempty"`
+}
+
+// Recorder appends an initial seed + keyframe and then one delta event per
+// tick to an append-only JSON-lines log, for later deterministic replay by
+// a Player.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	tick uint32
+}
+
+// startRecorder creates path (under recordingsDir, creating it on first
+// use) and writes the recording header (seed, grid size, and sync model),
+// which a Player needs to reconstruct the same simulation.
+func startRecorder(path string, seed int64, gridSize int, modelName string) (*Recorder, error) {
+	if err := os.MkdirAll(recordingsDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating recordings directory: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recorder{file: f, enc: json.NewEncoder(f)}
+	header := recordEvent{Seed: &seed, GridSize: gridSize, Model: modelName}
+	if err := rec.enc.Encode(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+// recordKeyframe writes the full initial state as tick 0, so a Player has
+// a baseline before any deltas are applied.
+func (rec *Recorder) recordKeyframe(flat []int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.writeLocked(0, toRecordedChanges(diffState(nil, flat)))
+}
+
+// recordTick appends the next tick's changes (which may be empty, to
+// preserve the original simulation's tick cadence for replay timing).
+func (rec *Recorder) recordTick(changes []recordedChange) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.tick++
+	rec.writeLocked(rec.tick, changes)
+}
+
+func (rec *Recorder) writeLocked(tick uint32, changes []recordedChange) {
+	if err := rec.enc.Encode(recordEvent{Tick: tick, Changes: changes}); err != nil {
+		// The recording is best-effort: a write failure shouldn't take down
+		// the simulation, just the recording.
+		fmt.Fprintf(os.Stderr, "recorder: write failed: %v\n", err)
+	}
+}
+
+// Close flushes and closes the underlying file.
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.file.Close()
+}
+
+// toRecordedChanges converts diffState's internal cellDelta slice to its
+// JSON-friendly mirror.
+func toRecordedChanges(deltas []cellDelta) []recordedChange {
+	if len(deltas) == 0 {
+		return nil
+	}
+	changes := make([]recordedChange, len(deltas))
+	for i, d := range deltas {
+		changes[i] = recordedChange{Index: d.index, State: d.state}
+	}
+	return changes
+}
+
+// Player replays a recording made by Recorder, advancing one recorded tick
+// per metronome step (scaled by speed) and exposing the resulting flat
+// state so Room.flattenState can serve it in place of a live simulation.
+type Player struct {
+	mu          sync.Mutex
+	events      []recordEvent // header stripped, in tick order
+	gridSize    int
+	seed        int64
+	modelName   string
+	speed       float64
+	ticker      *time.Ticker // set once run starts; SetSpeed resets its period
+	currentTick uint32
+	nextEvent   int
+	state       []int
+	playing     bool
+	done        chan struct{}
+}
+
+// loadPlayer reads a recording written by Recorder in full.
+func loadPlayer(path string) (*Player, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	var header recordEvent
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("reading recording header: %w", err)
+	}
+	if header.Seed == nil {
+		return nil, fmt.Errorf("recording %s is missing its header", path)
+	}
+
+	p := &Player{
+		gridSize:  header.GridSize,
+		seed:      *header.Seed,
+		modelName: header.Model,
+		speed:     1.0,
+		state:     make([]int, header.GridSize*header.GridSize),
+		done:      make(chan struct{}),
+	}
+	for {
+		var ev recordEvent
+		if err := dec.Decode(&ev); err != nil {
+			break
+		}
+		p.events = append(p.events, ev)
+	}
+	p.applyKeyframe()
+	return p, nil
+}
+
+// applyKeyframe applies events[0] (always the tick-0 keyframe written by
+// recordKeyframe) directly to state and advances nextEvent past it, so a
+// freshly loaded Player already reflects the initial frame instead of
+// waiting for the first advanceLocked call. advanceLocked only fires for
+// ticks >= 1, so without this the keyframe would never be applied during
+// normal playback.
+func (p *Player) applyKeyframe() {
+	if len(p.events) == 0 || p.events[0].Tick != 0 {
+		return
+	}
+	for _, c := range p.events[0].Changes {
+		p.state[c.Index] = c.State
+	}
+	p.nextEvent = 1
+}
+
+// run advances the player's currentTick on a ticker scaled by speed,
+// applying any recorded changes for that tick, until stopped via done.
+func (p *Player) run() {
+	p.mu.Lock()
+	p.ticker = time.NewTicker(p.tickInterval())
+	ticker := p.ticker
+	p.mu.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			if p.playing {
+				p.advanceLocked()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *Player) tickInterval() time.Duration {
+	return time.Duration(float64(100*time.Millisecond) / p.speed)
+}
+
+// advanceLocked moves the player forward by one recorded tick; callers
+// must hold p.mu.
+func (p *Player) advanceLocked() {
+	p.currentTick++
+	for p.nextEvent < len(p.events) && p.events[p.nextEvent].Tick == p.currentTick {
+		for _, c := range p.events[p.nextEvent].Changes {
+			p.state[c.Index] = c.State
+		}
+		p.nextEvent++
+	}
+}
+
+// currentState returns a copy of the player's current flat state.
+func (p *Player) currentState() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := make([]int, len(p.state))
+	copy(state, p.state)
+	return state
+}
+
+// Play resumes playback.
+func (p *Player) Play() {
+	p.mu.Lock()
+	p.playing = true
+	p.mu.Unlock()
+}
+
+// Pause halts playback in place.
+func (p *Player) Pause() {
+	p.mu.Lock()
+	p.playing = false
+	p.mu.Unlock()
+}
+
+// SetSpeed changes the playback rate (1x/2x/0.5x/...), resetting the
+// running ticker's period so it takes effect immediately rather than on
+// whatever cadence the old speed happened to be firing at.
+func (p *Player) SetSpeed(speed float64) {
+	if speed <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.speed = speed
+	if p.ticker != nil {
+		p.ticker.Reset(p.tickInterval())
+	}
+	p.mu.Unlock()
+}
+
+// Seek rebuilds state from the recording's start up to (and including)
+// targetTick, leaving playback paused at that point.
+func (p *Player) Seek(targetTick uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Zero, not -1: recordKeyframe's diffState(nil, ...) omits cells that
+	// are dim (state 0), relying on the zero value of a freshly-allocated
+	// []int to represent "dim" — the same convention loadPlayer's
+	// make([]int, ...) relies on. Resetting to -1 here made every
+	// previously-dim, untouched cell look inactive after a seek.
+	for i := range p.state {
+		p.state[i] = 0
+	}
+	p.currentTick = 0
+	p.nextEvent = 0
+	for p.nextEvent < len(p.events) && p.events[p.nextEvent].Tick <= targetTick {
+		for _, c := range p.events[p.nextEvent].Changes {
+			p.state[c.Index] = c.State
+		}
+		p.nextEvent++
+	}
+	p.currentTick = targetTick
+}
+
+// Stop ends the player's goroutine.
+func (p *Player) Stop() {
+	close(p.done)
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultRoomID is the room /ws (with no room ID in the path) connects to,
+// created automatically at startup so the server behaves like the
+// single-simulation version out of the box. It is exempt from idle GC.
+const defaultRoomID = "default"
+
+// defaultGridSize and defaultDensity are used for rooms created without an
+// explicit gridSize/density, matching the values this server has always
+// run with.
+const (
+	defaultGridSize = 30
+	defaultDensity  = 0.12
+)
+
+// maxGridSize bounds operator-supplied GridSize (via the admin endpoint) so
+// a single room can't be made to allocate unbounded memory.
+const maxGridSize = 500
+
+// roomIdleTimeout is how long a non-default room can sit with zero clients
+// before the hub's GC sweep tears it down.
+const roomIdleTimeout = 10 * time.Minute
+
+// RoomConfig describes the tunable parameters of a room: its grid size,
+// firefly density, sync model, and coupling (neighborhood radius, coupling
+// strength, noise). Used both when creating the default room and for
+// operator-created ones via the admin endpoint.
+type RoomConfig struct {
+	ID        string         `json:"id"`
+	GridSize  int            `json:"gridSize"`
+	Density   float32        `json:"density"`
+	ModelName string         `json:"model"`
+	Seed      int64          `json:"seed"`     // explicit RNG seed; 0 means "pick one and report it back"
+	Coupling  CouplingConfig `json:"coupling"` // zero fields fall back to defaultCoupling's, same as GridSize/Density
+}
+
+// maxCouplingRadius bounds operator-supplied Coupling.Radius, whose cost is
+// O(radius^2) per active firefly per tick.
+const maxCouplingRadius = 50
+
+// validate rejects operator-supplied RoomConfig values (from the admin
+// endpoint) that would panic in newRoomFromConfig or let a room allocate
+// unbounded memory or CPU. Zero values are left alone; newRoomFromConfig
+// applies defaults for those.
+func (cfg RoomConfig) validate() error {
+	if cfg.GridSize < 0 {
+		return fmt.Errorf("gridSize must not be negative, got %d", cfg.GridSize)
+	}
+	if cfg.GridSize > maxGridSize {
+		return fmt.Errorf("gridSize must not exceed %d, got %d", maxGridSize, cfg.GridSize)
+	}
+	if cfg.Density < 0 || cfg.Density > 1 {
+		return fmt.Errorf("density must be between 0 and 1, got %g", cfg.Density)
+	}
+	return cfg.Coupling.validate()
+}
+
+// validate rejects Coupling values that would be nonsensical (negative
+// radius) or too expensive (radius beyond maxCouplingRadius). Zero fields
+// are left alone; callers fall back to defaultCoupling's values for those.
+func (cfg CouplingConfig) validate() error {
+	if cfg.Radius < 0 {
+		return fmt.Errorf("coupling radius must not be negative, got %d", cfg.Radius)
+	}
+	if cfg.Radius > maxCouplingRadius {
+		return fmt.Errorf("coupling radius must not exceed %d, got %d", maxCouplingRadius, cfg.Radius)
+	}
+	if cfg.Strength < 0 {
+		return fmt.Errorf("coupling strength must not be negative, got %g", cfg.Strength)
+	}
+	if cfg.Noise < 0 {
+		return fmt.Errorf("coupling noise must not be negative, got %g", cfg.Noise)
+	}
+	return nil
+}
+
+// withDefaults fills any zero fields of cfg in from defaultCoupling, the
+// same "zero means unset" convention RoomConfig uses for GridSize/Density.
+func (cfg CouplingConfig) withDefaults() CouplingConfig {
+	if cfg.Radius == 0 {
+		cfg.Radius = defaultCoupling.Radius
+	}
+	if cfg.Strength == 0 {
+		cfg.Strength = defaultCoupling.Strength
+	}
+	return cfg
+}
+
+// roomSummary is the admin endpoint's read-only view of a room.
+type roomSummary struct {
+	RoomConfig
+	Clients int `json:"clients"`
+}
+
+// Room hosts one independent firefly simulation and the clients subscribed
+// to it. Every Room owns its own grid, mutex, and update/broadcast
+// goroutines, so load in one room never blocks another.
+type Room struct {
+	id           string
+	gridSize     int
+	density      float32
+	clients      map[*Client]bool
+	fireflies    [][]*Firefly
+	mutex        sync.RWMutex
+	broadcast    chan bool
+	seq          uint32
+	syncModel    SyncModel
+	coupling     CouplingConfig
+	seed         int64         // explicit RNG seed this room was created with, for reproducible replay
+	rng          *rand.Rand    // seeded from seed; all of this room's randomness must draw from it, not math/rand directly
+	recorder     *Recorder     // non-nil while this room is recording
+	recordPrev   []int         // last flat state handed to recorder, for diffing
+	player       *Player       // non-nil while this room is replaying a recording instead of simulating live
+	lastActivity time.Time     // last time a client joined or left, for idle GC
+	done         chan struct{} // closed by the hub's GC sweep to stop this room's goroutines
+}
+
+// newRoomFromConfig creates a Room from cfg, applying defaults for any
+// zero-valued fields. mask, if non-nil, restores a persisted active-cell
+// layout instead of a fresh random one. If cfg.Seed is 0 a seed is chosen
+// and written back into cfg so callers (e.g. the admin endpoint) can report
+// it to whoever needs to reproduce this exact run later.
+func newRoomFromConfig(cfg RoomConfig, mask []bool) *Room {
+	if cfg.GridSize == 0 {
+		cfg.GridSize = defaultGridSize
+	}
+	if cfg.Density == 0 {
+		cfg.Density = defaultDensity
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = rand.Int63()
+	}
+	cfg.Coupling = cfg.Coupling.withDefaults()
+
+	r := &Room{
+		id:           cfg.ID,
+		gridSize:     cfg.GridSize,
+		density:      cfg.Density,
+		clients:      make(map[*Client]bool),
+		fireflies:    make([][]*Firefly, cfg.GridSize),
+		broadcast:    make(chan bool),
+		syncModel:    lookupSyncModel(cfg.ModelName),
+		coupling:     cfg.Coupling,
+		seed:         cfg.Seed,
+		rng:          rand.New(rand.NewSource(cfg.Seed)),
+		lastActivity: time.Now(),
+		done:         make(chan struct{}),
+	}
+	for i := range r.fireflies {
+		r.fireflies[i] = make([]*Firefly, cfg.GridSize)
+		for j := range r.fireflies[i] {
+			r.fireflies[i][j] = &Firefly{x: i, y: j}
+		}
+	}
+	r.initializeState(mask)
+	return r
+}
+
+// initializeState sets up the initial set of active fireflies. If mask is
+// non-nil it is used verbatim (a restored snapshot); otherwise each cell is
+// activated independently at random according to r.density. Either way,
+// every active firefly gets a freshly drawn state blob: a restored room's
+// cells come back active/inactive in the same layout, but with each
+// firefly's in-cycle phase re-randomized rather than resumed. Known
+// limitation — see persistedState.
+func (r *Room) initializeState(mask []bool) {
+	for i := 0; i < r.gridSize; i++ {
+		for j := 0; j < r.gridSize; j++ {
+			active := r.rng.Float32() < r.density
+			if mask != nil {
+				active = mask[i*r.gridSize+j]
+			}
+			if active {
+				firefly := r.fireflies[i][j]
+				firefly.active = true
+				firefly.state = r.syncModel.Seed(r.rng)
+			}
+		}
+	}
+}
+
+// setSyncModel switches the room's active synchronization rule, re-seeding
+// every currently active firefly's state blob under the new model.
+func (r *Room) setSyncModel(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	model := lookupSyncModel(name)
+	r.syncModel = model
+	for i := 0; i < r.gridSize; i++ {
+		for j := 0; j < r.gridSize; j++ {
+			firefly := r.fireflies[i][j]
+			if firefly.active {
+				firefly.state = model.Seed(r.rng)
+			}
+		}
+	}
+}
+
+// setCoupling overrides the room's coupling parameters (neighborhood
+// radius, strength, noise) for live experimentation, letting a client
+// retune the active sync model via a "setCoupling:" control message
+// without restarting the simulation.
+func (r *Room) setCoupling(cfg CouplingConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.coupling = cfg
+}
+
+// currentCoupling returns the room's active coupling parameters.
+func (r *Room) currentCoupling() CouplingConfig {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.coupling
+}
+
+// parseCouplingUpdate parses a "setCoupling:" control message body, a
+// comma-separated list of key=value pairs (radius, strength, noise), into
+// an updated CouplingConfig. Fields not mentioned keep their value from
+// current, so a client can retune a single parameter at a time.
+func parseCouplingUpdate(current CouplingConfig, raw string) (CouplingConfig, error) {
+	cfg := current
+	if raw == "" {
+		return cfg, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return CouplingConfig{}, fmt.Errorf("malformed coupling field %q, want key=value", pair)
+		}
+		switch key {
+		case "radius":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return CouplingConfig{}, fmt.Errorf("invalid radius %q: %w", value, err)
+			}
+			cfg.Radius = n
+		case "strength":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return CouplingConfig{}, fmt.Errorf("invalid strength %q: %w", value, err)
+			}
+			cfg.Strength = f
+		case "noise":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return CouplingConfig{}, fmt.Errorf("invalid noise %q: %w", value, err)
+			}
+			cfg.Noise = f
+		default:
+			return CouplingConfig{}, fmt.Errorf("unknown coupling field %q", key)
+		}
+	}
+	return cfg, nil
+}
+
+// simTickInterval is the fixed virtual dt every sync model advances by on
+// each tick, independent of the ticker's actual real-time firing interval.
+// A SyncModel's Step must be a pure function of (state, dt, neighbors, rng),
+// so a room replayed live with the same seed and the same number of ticks
+// reproduces the same simulation bit-for-bit, regardless of scheduling
+// jitter in when the ticker actually fires.
+const simTickInterval = 100 * time.Millisecond
+
+// updateFireflies continuously updates the state of all fireflies in this
+// room until the room is torn down by the hub's GC sweep.
+func (r *Room) updateFireflies() {
+	ticker := time.NewTicker(simTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			dt := simTickInterval
+
+			if r.isReplaying() {
+				// A Player owns this room's visible state; leave the
+				// underlying grid untouched until replay stops.
+				continue
+			}
+
+			tickStart := time.Now()
+			var neighborScan time.Duration
+			flashing := 0
+			updated := false
+			r.mutex.Lock()
+			model := r.syncModel
+			coupling := r.coupling
+			for i := 0; i < r.gridSize; i++ {
+				for j := 0; j < r.gridSize; j++ {
+					firefly := r.fireflies[i][j]
+					if !firefly.active {
+						continue // Skip inactive fireflies
+					}
+
+					scanStart := time.Now()
+					neighbors := r.neighborStates(firefly, coupling.Radius)
+					neighborScan += time.Since(scanStart)
+					next, changed := model.Step(firefly.state, dt, neighbors, coupling, r.rng)
+					firefly.state = next
+					if changed {
+						updated = true
+					}
+					if model.DisplayState(next) == 1 {
+						flashing++
+					}
+				}
+			}
+			if updated {
+				r.seq++
+			}
+			r.mutex.Unlock()
+
+			metrics.ticksTotal.WithLabelValues(r.id).Inc()
+			metrics.tickDuration.WithLabelValues(r.id).Observe(time.Since(tickStart).Seconds())
+			metrics.neighborScanSeconds.WithLabelValues(r.id).Observe(neighborScan.Seconds())
+			metrics.flashingFireflies.WithLabelValues(r.id).Set(float64(flashing))
+
+			r.recordTick()
+
+			if updated {
+				select {
+				case r.broadcast <- true: // Signal that the state has been updated
+				case <-r.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// isReplaying reports whether a Player currently owns this room's visible
+// state in place of the live simulation.
+func (r *Room) isReplaying() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.player != nil
+}
+
+// recordTick, if this room is currently recording, appends the changes
+// since the last recorded tick (recording every tick, even empty ones, so
+// a Player can reproduce the original cadence).
+func (r *Room) recordTick() {
+	r.mutex.RLock()
+	rec := r.recorder
+	r.mutex.RUnlock()
+	if rec == nil {
+		return
+	}
+
+	flat := r.flattenState()
+	r.mutex.Lock()
+	prev := r.recordPrev
+	r.recordPrev = flat
+	r.mutex.Unlock()
+
+	if prev == nil {
+		rec.recordKeyframe(flat)
+		return
+	}
+	rec.recordTick(toRecordedChanges(diffState(prev, flat)))
+}
+
+// neighborStates gathers the model-specific state blobs of every active
+// firefly within radius cells of firefly, on the wrapped grid topology.
+func (r *Room) neighborStates(firefly *Firefly, radius int) []interface{} {
+	var neighbors []interface{}
+	for i := -radius; i <= radius; i++ {
+		for j := -radius; j <= radius; j++ {
+			if i == 0 && j == 0 {
+				continue // Skip the firefly itself
+			}
+			x := (firefly.x + i + r.gridSize) % r.gridSize
+			y := (firefly.y + j + r.gridSize) % r.gridSize
+			neighbor := r.fireflies[x][y]
+			if neighbor.active {
+				neighbors = append(neighbors, neighbor.state)
+			}
+		}
+	}
+	return neighbors
+}
+
+// addClient subscribes client to this room, sending it the current
+// keyframe so it starts in sync.
+func (r *Room) addClient(client *Client) {
+	r.mutex.Lock()
+	r.clients[client] = true
+	r.lastActivity = time.Now()
+	count := len(r.clients)
+	r.mutex.Unlock()
+
+	metrics.connectedClients.WithLabelValues(r.id).Set(float64(count))
+	log.Printf("Client joined room %q. Room clients: %d", r.id, count)
+	r.sendFullState(client)
+}
+
+// removeClient unsubscribes client from this room.
+func (r *Room) removeClient(client *Client) {
+	r.mutex.Lock()
+	delete(r.clients, client)
+	r.lastActivity = time.Now()
+	count := len(r.clients)
+	r.mutex.Unlock()
+
+	metrics.connectedClients.WithLabelValues(r.id).Set(float64(count))
+	log.Printf("Client left room %q. Room clients: %d", r.id, count)
+}
+
+// restartSimulation reinitializes the room's simulation.
+func (r *Room) restartSimulation() {
+	r.mutex.Lock()
+
+	// Reset all fireflies to inactive
+	for i := range r.fireflies {
+		for j := range r.fireflies[i] {
+			r.fireflies[i][j] = &Firefly{x: i, y: j}
+		}
+	}
+
+	// Reinitialize active fireflies
+	for i := 0; i < r.gridSize; i++ {
+		for j := 0; j < r.gridSize; j++ {
+			if r.rng.Float32() < r.density {
+				firefly := r.fireflies[i][j]
+				firefly.active = true
+				firefly.state = r.syncModel.Seed(r.rng)
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	// Broadcast the new state to all clients in this room
+	select {
+	case r.broadcast <- true:
+	case <-r.done:
+	}
+}
+
+// broadcastState sends updates to all clients connected to this room until
+// the room is torn down.
+func (r *Room) broadcastState() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.broadcast:
+			// State has been updated, but we don't need to do anything here
+		case <-ticker.C:
+			// Send updates every 100ms
+			flatState := r.flattenState()
+			r.mutex.RLock()
+			for client := range r.clients {
+				go func(client *Client) {
+					metrics.broadcastInFlight.WithLabelValues(r.id).Inc()
+					defer metrics.broadcastInFlight.WithLabelValues(r.id).Dec()
+					r.sendState(client, flatState)
+				}(client)
+			}
+			r.mutex.RUnlock()
+		}
+	}
+}
+
+// sendFullState sends the entire grid state to a single client as a
+// keyframe, resetting its delta-tracking baseline.
+func (r *Room) sendFullState(client *Client) {
+	flatState := r.flattenState()
+	r.sendState(client, flatState)
+}
+
+// sendState sends the current state to a single client, choosing JSON or
+// binary framing according to the client's negotiated protocol. In binary
+// mode it sends a sparse delta against the client's last acknowledged
+// state, falling back to a full keyframe every keyframeInterval ticks, on
+// reconnect, or whenever the client has no prior state to diff against.
+func (r *Room) sendState(client *Client, state []int) {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	writeStart := time.Now()
+	var err error
+	protocolLabel := "json"
+	switch client.protocol {
+	case protocolBinary:
+		protocolLabel = "binary"
+		seq := r.currentSeq()
+		if client.lastState == nil || seq%keyframeInterval == 0 {
+			err = client.conn.WriteMessage(websocket.BinaryMessage, encodeKeyframe(seq, state))
+		} else {
+			deltas := diffState(client.lastState, state)
+			err = client.conn.WriteMessage(websocket.BinaryMessage, encodeDelta(seq, deltas))
+		}
+		if err == nil {
+			client.lastState = state
+			client.lastSeq = seq
+		}
+	default:
+		err = client.conn.WriteJSON(state)
+	}
+	metrics.writeLatency.WithLabelValues(r.id, protocolLabel).Observe(time.Since(writeStart).Seconds())
+	if err != nil {
+		metrics.droppedClients.WithLabelValues(r.id).Inc()
+		log.Printf("Error broadcasting to client in room %q: %v", r.id, err)
+		r.removeClient(client)
+	}
+}
+
+// currentSeq returns the room's current tick sequence number.
+func (r *Room) currentSeq() uint32 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.seq
+}
+
+// flattenState converts the 2D grid into a 1D array for transmission,
+// mapping each firefly's model-specific state blob through the active
+// SyncModel's DisplayState. While a Player is active, its replayed state
+// is served instead of the (paused) live grid.
+func (r *Room) flattenState() []int {
+	r.mutex.RLock()
+	player := r.player
+	r.mutex.RUnlock()
+	if player != nil {
+		return player.currentState()
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	flatState := make([]int, r.gridSize*r.gridSize)
+	for i := 0; i < r.gridSize; i++ {
+		for j := 0; j < r.gridSize; j++ {
+			firefly := r.fireflies[i][j]
+			if !firefly.active {
+				flatState[i*r.gridSize+j] = -1
+				continue
+			}
+			flatState[i*r.gridSize+j] = r.syncModel.DisplayState(firefly.state)
+		}
+	}
+	return flatState
+}
+
+// summary returns the admin endpoint's read-only view of this room.
+func (r *Room) summary() roomSummary {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return roomSummary{
+		RoomConfig: RoomConfig{
+			ID:        r.id,
+			GridSize:  r.gridSize,
+			Density:   r.density,
+			ModelName: r.syncModel.Name(),
+			Seed:      r.seed,
+			Coupling:  r.coupling,
+		},
+		Clients: len(r.clients),
+	}
+}
+
+// snapshot captures this room's config and active-cell layout for
+// persistence across restarts. It does not capture in-cycle phase — see
+// persistedState.
+func (r *Room) snapshot() roomSnapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	active := make([]bool, r.gridSize*r.gridSize)
+	for i := 0; i < r.gridSize; i++ {
+		for j := 0; j < r.gridSize; j++ {
+			active[i*r.gridSize+j] = r.fireflies[i][j].active
+		}
+	}
+	return roomSnapshot{
+		RoomConfig: RoomConfig{
+			ID:        r.id,
+			GridSize:  r.gridSize,
+			Density:   r.density,
+			ModelName: r.syncModel.Name(),
+			Seed:      r.seed,
+			Coupling:  r.coupling,
+		},
+		Active: active,
+	}
+}
+
+// startRecording begins appending this room's tick-by-tick state to the
+// recording named id (resolved to a path inside recordingsDir by
+// recordingPath, never a client-supplied path), including the room's seed
+// and sync model so the recording can later be replayed deterministically.
+func (r *Room) startRecording(id string) error {
+	path, err := recordingPath(id)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.recorder != nil {
+		return fmt.Errorf("room %q is already recording", r.id)
+	}
+	rec, err := startRecorder(path, r.seed, r.gridSize, r.syncModel.Name())
+	if err != nil {
+		return err
+	}
+	r.recorder = rec
+	r.recordPrev = nil
+	return nil
+}
+
+// stopRecording ends the current recording, if any.
+func (r *Room) stopRecording() {
+	r.mutex.Lock()
+	rec := r.recorder
+	r.recorder = nil
+	r.mutex.Unlock()
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Printf("Error closing recording for room %q: %v", r.id, err)
+		}
+	}
+}
+
+// startReplay loads the recording named id (resolved to a path inside
+// recordingsDir by recordingPath, never a client-supplied path) and begins
+// streaming it through the room's normal broadcast path in place of the
+// live simulation; live updates resume once stopReplay is called.
+func (r *Room) startReplay(id string) error {
+	path, err := recordingPath(id)
+	if err != nil {
+		return err
+	}
+	player, err := loadPlayer(path)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	if r.player != nil {
+		r.player.Stop()
+	}
+	r.player = player
+	r.mutex.Unlock()
+
+	go player.run()
+	return nil
+}
+
+// stopReplay halts playback and hands control back to the live simulation.
+func (r *Room) stopReplay() {
+	r.mutex.Lock()
+	player := r.player
+	r.player = nil
+	r.mutex.Unlock()
+	if player != nil {
+		player.Stop()
+	}
+}
+
+// withPlayer runs fn against the active Player, if any.
+func (r *Room) withPlayer(fn func(*Player)) {
+	r.mutex.RLock()
+	player := r.player
+	r.mutex.RUnlock()
+	if player != nil {
+		fn(player)
+	}
+}
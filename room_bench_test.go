@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+// BenchmarkNeighborStates measures the cost of the O(radius^2) per-cell
+// scan in neighborStates, the hot spot called once per active firefly per
+// tick. Use this to compare against alternative approaches (e.g.
+// maintaining an active-flashing set instead of scanning the full radius).
+func BenchmarkNeighborStates(b *testing.B) {
+	room := newRoomFromConfig(RoomConfig{
+		ID:       "bench",
+		GridSize: defaultGridSize,
+		Density:  1.0, // every cell active, to exercise the worst case
+		Seed:     1,
+	}, nil)
+	firefly := room.fireflies[room.gridSize/2][room.gridSize/2]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		room.neighborStates(firefly, defaultCoupling.Radius)
+	}
+}
+
+// BenchmarkUpdateFirefliesTick measures one full grid pass of the update
+// loop's inner body (neighbor scan + model Step for every active firefly),
+// without the surrounding ticker/broadcast machinery.
+func BenchmarkUpdateFirefliesTick(b *testing.B) {
+	room := newRoomFromConfig(RoomConfig{
+		ID:       "bench",
+		GridSize: defaultGridSize,
+		Density:  defaultDensity,
+		Seed:     1,
+	}, nil)
+	dt := simTickInterval
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < room.gridSize; i++ {
+			for j := 0; j < room.gridSize; j++ {
+				firefly := room.fireflies[i][j]
+				if !firefly.active {
+					continue
+				}
+				neighbors := room.neighborStates(firefly, defaultCoupling.Radius)
+				firefly.state, _ = room.syncModel.Step(firefly.state, dt, neighbors, room.coupling, room.rng)
+			}
+		}
+	}
+}
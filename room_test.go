@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestRoomConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RoomConfig
+		wantErr bool
+	}{
+		{"zero value", RoomConfig{}, false},
+		{"gridSize at max", RoomConfig{GridSize: maxGridSize}, false},
+		{"gridSize over max", RoomConfig{GridSize: maxGridSize + 1}, true},
+		{"gridSize negative", RoomConfig{GridSize: -1}, true},
+		{"density at 0", RoomConfig{Density: 0}, false},
+		{"density at 1", RoomConfig{Density: 1}, false},
+		{"density negative", RoomConfig{Density: -0.01}, true},
+		{"density over 1", RoomConfig{Density: 1.01}, true},
+		{"coupling radius over max", RoomConfig{Coupling: CouplingConfig{Radius: maxCouplingRadius + 1}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCouplingConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     CouplingConfig
+		wantErr bool
+	}{
+		{"zero value", CouplingConfig{}, false},
+		{"radius at max", CouplingConfig{Radius: maxCouplingRadius}, false},
+		{"radius over max", CouplingConfig{Radius: maxCouplingRadius + 1}, true},
+		{"radius negative", CouplingConfig{Radius: -1}, true},
+		{"strength negative", CouplingConfig{Strength: -0.1}, true},
+		{"noise negative", CouplingConfig{Noise: -0.1}, true},
+		{"all positive", CouplingConfig{Radius: 5, Strength: 0.2, Noise: 0.05}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRoomExists is returned by createRoom when cfg.ID is already in use.
+var errRoomExists = errors.New("room already exists")
+
+// errTooManyRooms is returned by createRoom once the server already holds
+// maxRooms rooms, bounding the memory, goroutines, and metric label series
+// an operator (or anyone who guesses the admin token) can create.
+var errTooManyRooms = errors.New("too many rooms")
+
+// maxRooms caps the number of rooms a Server will hold at once.
+const maxRooms = 100
+
+// Server is the top-level hub: it owns every Room, keyed by room ID, and
+// routes incoming WebSocket connections and admin requests to them. Each
+// Room shards its own mutex, client set, and update goroutine, so load in
+// one room never blocks another.
+type Server struct {
+	rooms map[string]*Room
+	mutex sync.RWMutex
+}
+
+// newHub creates a Server and either restores its rooms from ps (a
+// persisted snapshot) or starts a single default room, so /ws behaves
+// exactly like the original single-simulation server when nothing else has
+// been configured.
+func newHub(ps *persistedState) *Server {
+	s := &Server{rooms: make(map[string]*Room)}
+	if ps != nil && len(ps.Rooms) > 0 {
+		for _, snapshot := range ps.Rooms {
+			s.addRoom(newRoomFromConfig(snapshot.RoomConfig, snapshot.Active))
+		}
+	} else {
+		cfg := RoomConfig{ID: defaultRoomID, GridSize: defaultGridSize, Density: defaultDensity, ModelName: modelNameFromEnv()}
+		s.addRoom(newRoomFromConfig(cfg, nil))
+	}
+	go s.gcLoop()
+	return s
+}
+
+// addRoom registers room with the hub and starts its update/broadcast
+// goroutines.
+func (s *Server) addRoom(r *Room) {
+	s.mutex.Lock()
+	s.rooms[r.id] = r
+	s.mutex.Unlock()
+	go r.updateFireflies()
+	go r.broadcastState()
+}
+
+// createRoom validates cfg, then atomically checks for an existing room
+// with cfg.ID and registers a new one if absent, all under a single lock
+// acquisition. Without that, two concurrent creates for the same new ID
+// could both pass the existence check and both register a room, orphaning
+// the first one's updateFireflies/broadcastState goroutines forever. It
+// also rejects the request once the server already holds maxRooms rooms.
+func (s *Server) createRoom(cfg RoomConfig, mask []bool) (*Room, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	if _, exists := s.rooms[cfg.ID]; exists {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("%q: %w", cfg.ID, errRoomExists)
+	}
+	if len(s.rooms) >= maxRooms {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("%d rooms already exist: %w", len(s.rooms), errTooManyRooms)
+	}
+	room := newRoomFromConfig(cfg, mask)
+	s.rooms[room.id] = room
+	s.mutex.Unlock()
+
+	go room.updateFireflies()
+	go room.broadcastState()
+	return room, nil
+}
+
+// getRoom looks up a room by ID.
+func (s *Server) getRoom(id string) (*Room, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	r, ok := s.rooms[id]
+	return r, ok
+}
+
+// gcLoop periodically tears down rooms that have had zero clients for
+// roomIdleTimeout. The default room is exempt so bare /ws connections
+// always have somewhere to land.
+func (s *Server) gcLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		for id, r := range s.rooms {
+			if id == defaultRoomID {
+				continue
+			}
+			r.mutex.RLock()
+			idle := len(r.clients) == 0 && time.Since(r.lastActivity) > roomIdleTimeout
+			r.mutex.RUnlock()
+			if idle {
+				// Stop any in-flight replay/recording before closing done:
+				// otherwise Player.run()'s goroutine/ticker and the
+				// recorder's open file are never told to stop and leak
+				// past the room's teardown.
+				r.stopReplay()
+				r.stopRecording()
+				close(r.done)
+				delete(s.rooms, id)
+				deleteRoomMetrics(id)
+				log.Printf("Room %q garbage collected after %s idle", id, roomIdleTimeout)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// handleConnections upgrades a WebSocket connection and subscribes it to
+// the room named in the URL path (/ws/{roomID}), falling back to
+// defaultRoomID for bare /ws.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	roomID := roomIDFromPath(r.URL.Path)
+	room, ok := s.getRoom(roomID)
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client := &Client{conn: conn, room: room, isAdmin: adminTokenValid(r)}
+	defer conn.Close()
+
+	room.addClient(client)
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			client.room.removeClient(client)
+			break
+		}
+
+		if mode, ok := parseHandshake(message); ok {
+			client.writeMu.Lock()
+			client.protocol = mode
+			client.lastState = nil // force a fresh keyframe in the new protocol
+			client.writeMu.Unlock()
+			client.room.sendFullState(client)
+			continue
+		}
+
+		text := string(message)
+		switch {
+		case text == "restart":
+			client.room.restartSimulation()
+		case strings.HasPrefix(text, "setModel:"):
+			client.room.setSyncModel(strings.TrimPrefix(text, "setModel:"))
+		case strings.HasPrefix(text, "setCoupling:"):
+			raw := strings.TrimPrefix(text, "setCoupling:")
+			cfg, err := parseCouplingUpdate(client.room.currentCoupling(), raw)
+			if err != nil {
+				log.Printf("setCoupling failed: %v", err)
+				break
+			}
+			if err := cfg.validate(); err != nil {
+				log.Printf("setCoupling failed: %v", err)
+				break
+			}
+			client.room.setCoupling(cfg)
+		case strings.HasPrefix(text, "join:"):
+			s.handleJoin(client, strings.TrimPrefix(text, "join:"))
+		case strings.HasPrefix(text, "record:start:"):
+			if !client.isAdmin {
+				log.Printf("record:start rejected: admin token required")
+				break
+			}
+			if err := client.room.startRecording(strings.TrimPrefix(text, "record:start:")); err != nil {
+				log.Printf("record:start failed: %v", err)
+			}
+		case text == "record:stop":
+			client.room.stopRecording()
+		case strings.HasPrefix(text, "replay:load:"):
+			if !client.isAdmin {
+				log.Printf("replay:load rejected: admin token required")
+				break
+			}
+			if err := client.room.startReplay(strings.TrimPrefix(text, "replay:load:")); err != nil {
+				log.Printf("replay:load failed: %v", err)
+			}
+		case text == "replay:play":
+			client.room.withPlayer((*Player).Play)
+		case text == "replay:pause":
+			client.room.withPlayer((*Player).Pause)
+		case strings.HasPrefix(text, "replay:seek:"):
+			if tick, err := strconv.ParseUint(strings.TrimPrefix(text, "replay:seek:"), 10, 32); err == nil {
+				client.room.withPlayer(func(p *Player) { p.Seek(uint32(tick)) })
+			}
+		case strings.HasPrefix(text, "replay:speed:"):
+			if speed, err := strconv.ParseFloat(strings.TrimPrefix(text, "replay:speed:"), 64); err == nil {
+				client.room.withPlayer(func(p *Player) { p.SetSpeed(speed) })
+			}
+		case text == "replay:stop":
+			client.room.stopReplay()
+		}
+	}
+}
+
+// handleJoin moves client from its current room to target, if target
+// exists, sending a fresh keyframe so it starts in sync with its new room.
+func (s *Server) handleJoin(client *Client, target string) {
+	room, ok := s.getRoom(target)
+	if !ok {
+		log.Printf("Join requested for unknown room %q", target)
+		return
+	}
+	client.room.removeClient(client)
+	client.room = room
+	client.writeMu.Lock()
+	client.lastState = nil
+	client.writeMu.Unlock()
+	room.addClient(client)
+}
+
+// roomIDFromPath extracts the room ID from a /ws or /ws/{roomID} request
+// path.
+func roomIDFromPath(path string) string {
+	trimmed := strings.TrimPrefix(path, "/ws/")
+	if trimmed == path || trimmed == "" {
+		return defaultRoomID
+	}
+	return trimmed
+}
+
+// handleAdminRooms lists existing rooms (GET) or creates a new one (POST),
+// letting operators stand up rooms with custom gridSize, density, and
+// sync-model parameters. Registered behind requireAdminToken, like
+// /debug/pprof/, since unrestricted room creation is an easy DoS surface.
+func (s *Server) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mutex.RLock()
+		summaries := make([]roomSummary, 0, len(s.rooms))
+		for _, room := range s.rooms {
+			summaries = append(summaries, room.summary())
+		}
+		s.mutex.RUnlock()
+		json.NewEncoder(w).Encode(summaries)
+
+	case http.MethodPost:
+		var req RoomConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		room, err := s.createRoom(req, nil)
+		if err != nil {
+			status := http.StatusBadRequest
+			switch {
+			case errors.Is(err, errRoomExists):
+				status = http.StatusConflict
+			case errors.Is(err, errTooManyRooms):
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(room.summary())
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// stopRoom closes a room's done channel, the same signal gcLoop's idle
+// sweep uses to stop updateFireflies/broadcastState, so tests that create
+// rooms via createRoom don't leak their ticking goroutines for the rest of
+// the test binary's life.
+func stopRoom(r *Room) {
+	close(r.done)
+}
+
+// TestServerCreateRoomConcurrentSameIDRegistersOnce fires concurrent
+// createRoom calls for the same new ID and asserts only one of them wins:
+// before createRoom held a single lock across its exists-check and insert,
+// two concurrent creates for the same ID could both pass the check and
+// both register a room, orphaning the loser's updateFireflies/
+// broadcastState goroutines forever.
+func TestServerCreateRoomConcurrentSameIDRegistersOnce(t *testing.T) {
+	s := &Server{rooms: make(map[string]*Room)}
+	const attempts = 20
+
+	var wg sync.WaitGroup
+	successes := make(chan *Room, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room, err := s.createRoom(RoomConfig{ID: "race"}, nil)
+			if err == nil {
+				successes <- room
+			}
+		}()
+	}
+	wg.Wait()
+	close(successes)
+
+	won := 0
+	for room := range successes {
+		won++
+		defer stopRoom(room)
+	}
+	if won != 1 {
+		t.Fatalf("%d of %d concurrent createRoom calls succeeded, want exactly 1", won, attempts)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.rooms) != 1 {
+		t.Fatalf("server holds %d rooms after the race, want 1", len(s.rooms))
+	}
+}
+
+// TestServerCreateRoomRejectsInvalidConfig checks createRoom surfaces
+// RoomConfig.validate()'s error instead of registering a room built from
+// out-of-bounds fields.
+func TestServerCreateRoomRejectsInvalidConfig(t *testing.T) {
+	s := &Server{rooms: make(map[string]*Room)}
+	if _, err := s.createRoom(RoomConfig{ID: "bad", GridSize: maxGridSize + 1}, nil); err == nil {
+		t.Fatal("createRoom with oversized gridSize succeeded, want an error")
+	}
+	if len(s.rooms) != 0 {
+		t.Fatalf("server holds %d rooms after a rejected create, want 0", len(s.rooms))
+	}
+}
+
+// TestServerCreateRoomRejectsOverCapacity checks createRoom refuses once
+// the server already holds maxRooms rooms.
+func TestServerCreateRoomRejectsOverCapacity(t *testing.T) {
+	s := &Server{rooms: make(map[string]*Room)}
+	for i := 0; i < maxRooms; i++ {
+		room, err := s.createRoom(RoomConfig{ID: roomIDForTest(i)}, nil)
+		if err != nil {
+			t.Fatalf("createRoom #%d: %v", i, err)
+		}
+		defer stopRoom(room)
+	}
+	if _, err := s.createRoom(RoomConfig{ID: "one-too-many"}, nil); err == nil {
+		t.Fatal("createRoom beyond maxRooms succeeded, want an error")
+	}
+}
+
+func roomIDForTest(i int) string {
+	return "room-" + string(rune('a'+i%26)) + string(rune('0'+i/26))
+}
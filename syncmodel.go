@@ -0,0 +1,261 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// CouplingConfig holds the tunable parameters shared by all sync models, so
+// experimenting with a model doesn't require touching its code.
+type CouplingConfig struct {
+	Radius   int     // neighborhood radius, in grid cells (topology is always the wrapped Moore neighborhood)
+	Strength float64 // coupling strength (epsilon for Mirollo-Strogatz, K for Kuramoto)
+	Noise    float64 // stochastic jitter applied to phase advance (Ermentrout model only)
+}
+
+// defaultCoupling matches the radius and nudge strength the hardcoded loop
+// used before sync models became pluggable.
+var defaultCoupling = CouplingConfig{Radius: 10, Strength: 0.1, Noise: 0.0}
+
+// SyncModel is a pluggable firefly synchronization rule. A Server has one
+// active SyncModel at a time; switching models re-seeds every firefly's
+// state blob.
+type SyncModel interface {
+	// Name identifies the model for config and control-message selection.
+	Name() string
+	// Seed returns a freshly initialized state blob for an active firefly.
+	Seed(rng *rand.Rand) interface{}
+	// Step advances one firefly's state by dt given the model-specific
+	// state blobs of the fireflies currently within its neighborhood,
+	// returning the next state blob and whether the firefly's externally
+	// visible flash state changed this tick. rng is the room's seeded RNG;
+	// models with a stochastic component (e.g. Ermentrout) must draw from
+	// it rather than the global math/rand functions, and any elapsed-time
+	// bookkeeping (e.g. a flash window) must be measured in dt, not
+	// time.Now(), so that a room's explicit seed reproduces its simulation
+	// bit-for-bit given the same sequence of dt values.
+	Step(state interface{}, dt time.Duration, neighbors []interface{}, cfg CouplingConfig, rng *rand.Rand) (next interface{}, changed bool)
+	// DisplayState maps a state blob to the wire representation used by
+	// flattenState/sendState: -1 inactive, 0 dim, 1 flashing.
+	DisplayState(state interface{}) int
+}
+
+// syncModels is the registry of models selectable by name, via config or
+// the "setModel:<name>" WebSocket control message.
+var syncModels = map[string]SyncModel{
+	"mirollo-strogatz": mirolloStrogatzModel{},
+	"kuramoto":         kuramotoModel{},
+	"ermentrout":       ermentroutModel{},
+}
+
+// defaultModelName is used when no model is configured at server start.
+const defaultModelName = "mirollo-strogatz"
+
+// lookupSyncModel returns the named model, falling back to the default if
+// the name is unknown.
+func lookupSyncModel(name string) SyncModel {
+	if m, ok := syncModels[name]; ok {
+		return m
+	}
+	return syncModels[defaultModelName]
+}
+
+// --- Mirollo-Strogatz pulse-coupled oscillator -----------------------------
+
+// msState is the per-firefly state for the classic Mirollo-Strogatz model:
+// a phase that climbs linearly from 0 to 1 and fires on reaching 1, with
+// neighbor flashes advancing the phase through a concave firing function.
+type msState struct {
+	phase         float64
+	cycleRate     time.Duration
+	flashDuration time.Duration
+	flashing      bool
+	flashElapsed  time.Duration // time spent flashing so far, advanced by dt
+}
+
+type mirolloStrogatzModel struct{}
+
+func (mirolloStrogatzModel) Name() string { return "mirollo-strogatz" }
+
+func (mirolloStrogatzModel) Seed(rng *rand.Rand) interface{} {
+	return &msState{
+		phase:         rng.Float64(),
+		cycleRate:     time.Duration(rng.Float64()*2000+4000) * time.Millisecond,
+		flashDuration: time.Duration(rng.Float64()*133+600) * time.Millisecond,
+	}
+}
+
+// msFiringFunction is the concave firing function f(phase) used to map a
+// linear phase onto the nonlinear excitability curve Mirollo-Strogatz
+// oscillators fire on; phase*(2-phase) is concave and increasing on [0,1].
+func msFiringFunction(phase float64) float64 {
+	return phase * (2 - phase)
+}
+
+func (m mirolloStrogatzModel) Step(state interface{}, dt time.Duration, neighbors []interface{}, cfg CouplingConfig, rng *rand.Rand) (interface{}, bool) {
+	st := state.(*msState)
+
+	if st.flashing {
+		st.flashElapsed += dt
+		if st.flashElapsed >= st.flashDuration {
+			st.flashing = false
+			return st, true
+		}
+		return st, false
+	}
+
+	st.phase += float64(dt) / float64(st.cycleRate)
+
+	if neighborFlashing(neighbors, m) {
+		st.phase = math.Min(1, msFiringFunction(st.phase)+cfg.Strength)
+	}
+
+	if st.phase >= 1 {
+		st.phase = 0
+		st.flashing = true
+		st.flashElapsed = 0
+		return st, true
+	}
+	return st, false
+}
+
+func (mirolloStrogatzModel) DisplayState(state interface{}) int {
+	st := state.(*msState)
+	if st.flashing {
+		return 1
+	}
+	return 0
+}
+
+// --- Kuramoto continuous phase coupling ------------------------------------
+
+// kuramotoState holds a firefly's phase (in radians) and natural frequency.
+// It "flashes" whenever its phase crosses 0, i.e. the top of its cycle.
+type kuramotoState struct {
+	phase    float64
+	omega    float64 // natural frequency, radians/sec
+	flashing bool
+}
+
+type kuramotoModel struct{}
+
+func (kuramotoModel) Name() string { return "kuramoto" }
+
+func (kuramotoModel) Seed(rng *rand.Rand) interface{} {
+	return &kuramotoState{
+		phase: rng.Float64() * 2 * math.Pi,
+		omega: 2 * math.Pi / (rng.Float64()*2 + 4), // period between 4s and 6s
+	}
+}
+
+func (kuramotoModel) Step(state interface{}, dt time.Duration, neighbors []interface{}, cfg CouplingConfig, rng *rand.Rand) (interface{}, bool) {
+	st := state.(*kuramotoState)
+	dtSec := dt.Seconds()
+
+	coupling := 0.0
+	n := 0
+	for _, raw := range neighbors {
+		if neighbor, ok := raw.(*kuramotoState); ok {
+			coupling += math.Sin(neighbor.phase - st.phase)
+			n++
+		}
+	}
+	if n > 0 {
+		coupling = cfg.Strength * coupling / float64(n)
+	}
+
+	prevPhase := st.phase
+	st.phase += (st.omega + coupling) * dtSec
+	st.phase = math.Mod(st.phase, 2*math.Pi)
+	if st.phase < 0 {
+		st.phase += 2 * math.Pi
+	}
+
+	// The firefly flashes for a short window around phase 0, i.e. when the
+	// phase wraps past the top of its cycle.
+	wrapped := st.phase < prevPhase
+	wasFlashing := st.flashing
+	st.flashing = wrapped || (st.flashing && st.phase < 0.2)
+	return st, st.flashing != wasFlashing
+}
+
+func (kuramotoModel) DisplayState(state interface{}) int {
+	st := state.(*kuramotoState)
+	if st.flashing {
+		return 1
+	}
+	return 0
+}
+
+// --- Ermentrout stochastic model --------------------------------------------
+
+// ermentroutState is a Mirollo-Strogatz-style oscillator with noisy phase
+// advance and a probabilistic response to neighbor pulses, after
+// Ermentrout's analysis of noisy pulse-coupled oscillator populations.
+type ermentroutState struct {
+	phase         float64
+	cycleRate     time.Duration
+	flashDuration time.Duration
+	flashing      bool
+	flashElapsed  time.Duration // time spent flashing so far, advanced by dt
+}
+
+type ermentroutModel struct{}
+
+func (ermentroutModel) Name() string { return "ermentrout" }
+
+func (ermentroutModel) Seed(rng *rand.Rand) interface{} {
+	return &ermentroutState{
+		phase:         rng.Float64(),
+		cycleRate:     time.Duration(rng.Float64()*2000+4000) * time.Millisecond,
+		flashDuration: time.Duration(rng.Float64()*133+600) * time.Millisecond,
+	}
+}
+
+func (m ermentroutModel) Step(state interface{}, dt time.Duration, neighbors []interface{}, cfg CouplingConfig, rng *rand.Rand) (interface{}, bool) {
+	st := state.(*ermentroutState)
+
+	if st.flashing {
+		st.flashElapsed += dt
+		if st.flashElapsed >= st.flashDuration {
+			st.flashing = false
+			return st, true
+		}
+		return st, false
+	}
+
+	jitter := 1 + cfg.Noise*(rng.Float64()*2-1)
+	st.phase += jitter * float64(dt) / float64(st.cycleRate)
+
+	if neighborFlashing(neighbors, m) && rng.Float64() < cfg.Strength {
+		st.phase = 1
+	}
+
+	if st.phase >= 1 {
+		st.phase = 0
+		st.flashing = true
+		st.flashElapsed = 0
+		return st, true
+	}
+	return st, false
+}
+
+func (ermentroutModel) DisplayState(state interface{}) int {
+	st := state.(*ermentroutState)
+	if st.flashing {
+		return 1
+	}
+	return 0
+}
+
+// neighborFlashing reports whether any neighbor state blob is currently in
+// the flashing display state, according to m.
+func neighborFlashing(neighbors []interface{}, m SyncModel) bool {
+	for _, n := range neighbors {
+		if m.DisplayState(n) == 1 {
+			return true
+		}
+	}
+	return false
+}